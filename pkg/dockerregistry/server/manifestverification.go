@@ -0,0 +1,85 @@
+package server
+
+import (
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+)
+
+// verifyManifest checks manifest (identified by dgst, fetched on behalf
+// of repoName) against m.repo's trust policy: a schema1 manifest's JWS
+// signatures must come from a trusted key if the policy lists any for
+// repoName, and any manifest is rejected if repoName is pinned to a
+// different digest. It returns distribution.ErrManifestUnverified on
+// either failure. Callers must not populate cachedLayers when this
+// returns an error.
+func (m *pullthroughManifestService) verifyManifest(ctx context.Context, repoName string, dgst digest.Digest, manifest distribution.Manifest) error {
+	if pinned, ok := pinnedDigestFromImageStream(m.repo.imageStream(ctx)); ok && pinned != dgst {
+		context.GetLogger(m.repo.ctx).Errorf("pullthrough manifest %s for %s does not match image stream pinned digest %s", dgst, repoName, pinned)
+		return distribution.ErrManifestUnverified{}
+	}
+
+	policy := m.repo.trustPolicy(ctx)
+	if policy == nil {
+		return nil
+	}
+
+	if pinned, ok := policy.pinnedDigestFor(repoName); ok && pinned != dgst {
+		context.GetLogger(m.repo.ctx).Errorf("pullthrough manifest %s for %s does not match pinned digest %s", dgst, repoName, pinned)
+		return distribution.ErrManifestUnverified{}
+	}
+
+	if signed, ok := manifest.(*schema1.SignedManifest); ok {
+		if allowedKeyIDs, ok := policy.allowedKeyIDsFor(repoName); ok {
+			if err := verifySchema1Signatures(signed, allowedKeyIDs); err != nil {
+				context.GetLogger(m.repo.ctx).Errorf("pullthrough manifest %s for %s failed signature verification: %v", dgst, repoName, err)
+				return distribution.ErrManifestUnverified{}
+			}
+		}
+	}
+
+	return nil
+}
+
+// verifySchema1Signatures checks that at least one of the JWS signatures
+// on signed was produced by a key whose ID appears in allowedKeyIDs.
+func verifySchema1Signatures(signed *schema1.SignedManifest, allowedKeyIDs []string) error {
+	keys, err := schema1.Verify(signed)
+	if err != nil {
+		return err
+	}
+
+	allowed := make(map[string]bool, len(allowedKeyIDs))
+	for _, id := range allowedKeyIDs {
+		allowed[id] = true
+	}
+
+	for _, key := range keys {
+		if allowed[key.KeyID()] {
+			return nil
+		}
+	}
+	return errUntrustedSigningKey{}
+}
+
+type errUntrustedSigningKey struct{}
+
+func (errUntrustedSigningKey) Error() string {
+	return "manifest was not signed by a trusted key"
+}
+
+// pinnedDigestFromImageStream returns the digest pinned by the
+// ImagePinnedDigestAnnotation on is, if any.
+func pinnedDigestFromImageStream(is *imageapi.ImageStream) (digest.Digest, bool) {
+	if is == nil || is.Annotations == nil {
+		return "", false
+	}
+	pin, ok := is.Annotations[ImagePinnedDigestAnnotation]
+	if !ok || pin == "" {
+		return "", false
+	}
+	return digest.Digest(pin), true
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+
+	imageapi "github.com/openshift/origin/pkg/image/api"
+)
+
+func TestVerifySchema1SignaturesTrustedKey(t *testing.T) {
+	signedManifest := &schema1.SignedManifest{}
+	if err := json.Unmarshal([]byte(etcdManifest), signedManifest); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := schema1.Verify(signedManifest)
+	if err != nil {
+		t.Fatalf("unexpected error verifying signature payload: %v", err)
+	}
+	if len(keys) == 0 {
+		t.Fatal("expected at least one signing key")
+	}
+
+	if err := verifySchema1Signatures(signedManifest, []string{keys[0].KeyID()}); err != nil {
+		t.Errorf("expected verification to succeed for a trusted key, got %v", err)
+	}
+}
+
+func TestVerifySchema1SignaturesUntrustedKey(t *testing.T) {
+	signedManifest := &schema1.SignedManifest{}
+	if err := json.Unmarshal([]byte(etcdManifest), signedManifest); err != nil {
+		t.Fatal(err)
+	}
+
+	err := verifySchema1Signatures(signedManifest, []string{"SHA256:deadbeefdeadbeefdeadbeefdeadbeef"})
+	if err == nil {
+		t.Fatal("expected verification to fail for an untrusted key")
+	}
+}
+
+func TestPinnedDigestFromImageStream(t *testing.T) {
+	if _, ok := pinnedDigestFromImageStream(nil); ok {
+		t.Errorf("expected no pin for a nil image stream")
+	}
+
+	is := &imageapi.ImageStream{}
+	if _, ok := pinnedDigestFromImageStream(is); ok {
+		t.Errorf("expected no pin without annotations")
+	}
+
+	is.Annotations = map[string]string{ImagePinnedDigestAnnotation: etcdDigest}
+	dgst, ok := pinnedDigestFromImageStream(is)
+	if !ok {
+		t.Fatalf("expected a pinned digest")
+	}
+	if dgst != digest.Digest(etcdDigest) {
+		t.Errorf("expected pinned digest %q, got %q", etcdDigest, dgst)
+	}
+}
@@ -0,0 +1,193 @@
+// Package ociclient implements a minimal HTTP client for the OCI
+// distribution specification, used as an alternative to the full
+// docker/distribution registry client for remotes that only need basic
+// manifest and blob pulls with correct Accept-header negotiation.
+package ociclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+// acceptedManifestMediaTypes is sent as the Accept header on every
+// manifest pull, in preference order: schema2, OCI image index, Docker
+// manifest list, schema1.
+var acceptedManifestMediaTypes = strings.Join([]string{
+	schema2.MediaTypeManifest,
+	"application/vnd.oci.image.index.v1+json",
+	manifestlist.MediaTypeManifestList,
+	schema1.MediaTypeSignedManifest,
+}, ", ")
+
+// Client is a thin HTTP client for the `/v2/...` distribution-spec
+// endpoints of a single registry host.
+type Client struct {
+	hostname string
+	insecure bool
+	http     *http.Client
+
+	mu      sync.Mutex
+	baseURL string
+}
+
+// New creates a Client for hostname, which may be a bare host[:port] or a
+// full base URL (e.g. for pointing a test at a known scheme). When
+// insecure is true, TLS certificate verification is skipped and, if an
+// HTTPS request fails outright, plain HTTP is tried instead and
+// remembered for subsequent requests, matching the docker daemon's
+// handling of insecure registries.
+func New(hostname string, insecure bool) (*Client, error) {
+	transport := &http.Transport{}
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	baseURL := hostname
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + hostname
+	}
+
+	return &Client{
+		hostname: hostname,
+		insecure: insecure,
+		http:     &http.Client{Transport: transport},
+		baseURL:  baseURL,
+	}, nil
+}
+
+func (c *Client) currentBaseURL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.baseURL
+}
+
+// fallBackToHTTP permanently switches the client to plain HTTP against
+// hostname, so that once the fallback has been proven to work it applies
+// to every later request instead of being re-probed each time.
+func (c *Client) fallBackToHTTP() {
+	c.mu.Lock()
+	c.baseURL = "http://" + c.hostname
+	c.mu.Unlock()
+}
+
+// do builds and issues a request via newReq against the client's current
+// base URL, attaching ctx so the caller's timeout or cancellation governs
+// the request. If the attempt fails outright and the client is insecure,
+// it retries once over plain HTTP and, on success, switches the client
+// to HTTP for subsequent requests.
+func (c *Client) do(ctx context.Context, newReq func(baseURL string) (*http.Request, error)) (*http.Response, error) {
+	baseURL := c.currentBaseURL()
+	req, err := newReq(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err == nil || !c.insecure || !strings.HasPrefix(baseURL, "https://") {
+		return resp, err
+	}
+
+	fallbackReq, buildErr := newReq("http://" + c.hostname)
+	if buildErr != nil {
+		return nil, err
+	}
+	fallbackResp, fallbackErr := c.http.Do(fallbackReq.WithContext(ctx))
+	if fallbackErr != nil {
+		return nil, err
+	}
+	c.fallBackToHTTP()
+	return fallbackResp, nil
+}
+
+// Ping issues a GET against the base /v2/ endpoint to confirm the
+// remote speaks the distribution API.
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, func(baseURL string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, baseURL+"/v2/", nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("unexpected status pinging %s: %s", c.currentBaseURL(), resp.Status)
+	}
+	return nil
+}
+
+// GetManifest fetches the manifest identified by ref (tag or digest)
+// from repo, negotiating the media type via the Accept header and
+// returning the media type the server actually responded with. When ref
+// is itself a digest, the fetched payload's digest must match it exactly
+// or the manifest is rejected, since a remote could otherwise return
+// different content under the digest the caller asked for.
+func (c *Client) GetManifest(ctx context.Context, repo, ref string) (distribution.Manifest, string, error) {
+	resp, err := c.do(ctx, func(baseURL string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/manifests/%s", baseURL, repo, ref), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", acceptedManifestMediaTypes)
+		return req, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, "", distribution.ErrManifestUnknownRevision{Name: repo, Revision: digest.Digest(ref)}
+		}
+		return nil, "", fmt.Errorf("unexpected status fetching manifest %s/%s: %s", repo, ref, resp.Status)
+	}
+
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if requested, err := digest.ParseDigest(ref); err == nil {
+		if actual := digest.FromBytes(payload); actual != requested {
+			return nil, "", fmt.Errorf("manifest %s/%s: digest mismatch, got %s", repo, ref, actual)
+		}
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	manifest, _, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return nil, "", err
+	}
+	return manifest, mediaType, nil
+}
+
+// GetBlob fetches the blob identified by dgst from repo.
+func (c *Client) GetBlob(ctx context.Context, repo string, dgst digest.Digest) ([]byte, error) {
+	resp, err := c.do(ctx, func(baseURL string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/blobs/%s", baseURL, repo, dgst), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, distribution.ErrBlobUnknown
+		}
+		return nil, fmt.Errorf("unexpected status fetching blob %s/%s: %s", repo, dgst, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
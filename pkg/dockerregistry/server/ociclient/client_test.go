@@ -0,0 +1,98 @@
+package ociclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+const testSchema2Manifest = `{
+   "schemaVersion": 2,
+   "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+   "config": {
+      "mediaType": "application/vnd.docker.container.image.v1+json",
+      "size": 2,
+      "digest": "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+   },
+   "layers": []
+}`
+
+func TestClientGetManifest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Accept"); got == "" {
+			t.Errorf("expected an Accept header to be sent")
+		}
+		w.Header().Set("Content-Type", schema2.MediaTypeManifest)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(testSchema2Manifest))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server is plain HTTP; New defaults to HTTPS, so insecure=true
+	// is what drives the client to fall back to HTTP on the first
+	// request, rather than reaching into an unexported field.
+	c, err := New(u.Host, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, mediaType, err := c.GetManifest(context.Background(), "user/app", "latest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mediaType != schema2.MediaTypeManifest {
+		t.Errorf("expected media type %q, got %q", schema2.MediaTypeManifest, mediaType)
+	}
+	if manifest == nil {
+		t.Fatalf("expected a manifest")
+	}
+}
+
+func TestClientGetManifestDigestMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", schema2.MediaTypeManifest)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(testSchema2Manifest))
+	}))
+	defer server.Close()
+
+	c, err := New(server.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any digest is a mismatch here since it doesn't match the content
+	// the handler above actually serves.
+	const wrongDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	if _, _, err := c.GetManifest(context.Background(), "user/app", wrongDigest); err == nil {
+		t.Fatalf("expected an error for a manifest whose digest doesn't match the requested one")
+	}
+}
+
+func TestClientGetManifestNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	// Passing the httptest server's full URL (scheme included) points the
+	// client straight at it without needing the insecure fallback or an
+	// unexported field.
+	c, err := New(server.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := c.GetManifest(context.Background(), "user/app", "missing"); err == nil {
+		t.Fatalf("expected an error for a missing manifest")
+	}
+}
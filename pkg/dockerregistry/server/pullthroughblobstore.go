@@ -0,0 +1,75 @@
+package server
+
+import (
+	stdcontext "context"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+
+	"github.com/openshift/origin/pkg/dockerregistry/server/xfer"
+)
+
+// blobTransferManager is the blob-store counterpart of
+// manifestTransferManager: it deduplicates and rate-limits concurrent
+// pullthrough blob fetches the same way, keyed by the blob's digest, and
+// is tuned by the same environment variables (see transferConfigFromEnv).
+var blobTransferManager = xfer.NewManager(transferConfigFromEnv(), isBlobFetchRetryable)
+
+// isBlobFetchRetryable reports whether a failed blob fetch is worth
+// retrying with backoff.
+func isBlobFetchRetryable(err error) bool {
+	switch err {
+	case distribution.ErrBlobUnknown:
+		return false
+	default:
+		return err != nil
+	}
+}
+
+// pullthroughBlobStore wraps a distribution.BlobStore and falls through
+// to the remote repository that owns a blob when it is not present
+// locally and the repository has pullthrough enabled.
+type pullthroughBlobStore struct {
+	distribution.BlobStore
+	repo *repository
+}
+
+var _ distribution.BlobStore = &pullthroughBlobStore{}
+
+// Get retrieves the blob identified by dgst, deduplicating concurrent
+// remote fetches for the same digest via blobTransferManager.
+func (p *pullthroughBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	content, err := p.BlobStore.Get(ctx, dgst)
+	switch err {
+	case distribution.ErrBlobUnknown:
+		break
+	case nil:
+		return content, nil
+	default:
+		return nil, err
+	}
+
+	if !p.repo.pullthrough {
+		return nil, err
+	}
+
+	ref, ok := p.repo.remoteRefForBlob(dgst)
+	if !ok {
+		return nil, err
+	}
+
+	client, err := newRemoteRegistryClient(ref.Registry, p.repo.insecure)
+	if err != nil {
+		context.GetLogger(p.repo.ctx).Errorf("error creating remote registry client for blob %q: %v", dgst, err)
+		return nil, err
+	}
+
+	result, err := blobTransferManager.Transfer(ctx, ref.Registry, ref.RepositoryName(), dgst, func(transferCtx stdcontext.Context) (interface{}, error) {
+		return client.PullBlob(transferCtx, ref.RepositoryName(), distribution.Descriptor{Digest: dgst})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]byte), nil
+}
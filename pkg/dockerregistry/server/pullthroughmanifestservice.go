@@ -0,0 +1,190 @@
+package server
+
+import (
+	stdcontext "context"
+	"fmt"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+
+	"github.com/openshift/origin/pkg/dockerregistry/server/xfer"
+	imageapi "github.com/openshift/origin/pkg/image/api"
+)
+
+// manifestTransferManager deduplicates and rate-limits concurrent
+// pullthrough manifest fetches across repositories, so that many pods
+// pulling the same image at once result in a single outbound request per
+// digest instead of a thundering herd against the remote registry. Its
+// concurrency limits and retry pacing are tunable by an operator; see
+// transferConfigFromEnv.
+var manifestTransferManager = xfer.NewManager(transferConfigFromEnv(), isManifestFetchRetryable)
+
+// isManifestFetchRetryable reports whether a failed manifest fetch is
+// worth retrying with backoff. Errors indicating the manifest simply
+// doesn't exist are not retryable; anything else (network failures, 5xx
+// responses) is assumed transient.
+func isManifestFetchRetryable(err error) bool {
+	switch err.(type) {
+	case distribution.ErrManifestUnknownRevision, distribution.ErrManifestUnknown:
+		return false
+	default:
+		return err != nil
+	}
+}
+
+// pullthroughManifestService wraps a distribution.ManifestService
+// and falls through to a remote repository when the requested manifest is
+// not present locally and the repository has pullthrough enabled.
+type pullthroughManifestService struct {
+	distribution.ManifestService
+	repo *repository
+}
+
+var _ distribution.ManifestService = &pullthroughManifestService{}
+
+// Get retrieves the manifest identified by dgst. When the manifest is not
+// known locally and the repository is pullthrough-enabled, it is retrieved
+// from the remote repository recorded for the image with that digest. If
+// the remote manifest is a manifest list (Docker) or an image index (OCI),
+// each platform-specific manifest it references is resolved in turn so
+// that their layer digests get recorded in cachedLayers; the list itself
+// is returned to the client unmodified.
+func (m *pullthroughManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, err := m.ManifestService.Get(ctx, dgst, options...)
+	switch err.(type) {
+	case distribution.ErrManifestUnknownRevision:
+		if !m.repo.pullthrough {
+			return nil, err
+		}
+		context.GetLogger(m.repo.ctx).Infof("(*pullthroughManifestService).Get: starting pullthrough for digest %s", dgst)
+		manifest, err = m.remoteGet(ctx, dgst, options...)
+		if err != nil {
+			return nil, err
+		}
+	case nil:
+		// served locally; still subject to schema2 conversion below
+	default:
+		return nil, err
+	}
+
+	if converted, ok, err := m.convertToRequestedSchema(ctx, dgst, manifest, options); err != nil {
+		return nil, err
+	} else if ok {
+		return converted, nil
+	}
+	return manifest, nil
+}
+
+// remoteGet locates the source registry for dgst via the OpenShift image
+// referenced by the repository's image stream and fetches the manifest
+// from there, through whatever RemoteRegistryClient is registered for
+// that registry host (see registryclient.go). The fetch itself is
+// funneled through manifestTransferManager so that concurrent Get calls
+// for the same digest, whether from this repository or another one
+// backed by the same remote, share a single outbound request.
+func (m *pullthroughManifestService) remoteGet(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	ref, err := m.repo.remoteRefForDigest(dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newRemoteRegistryClient(ref.Registry, m.repo.insecure)
+	if err != nil {
+		context.GetLogger(m.repo.ctx).Errorf("error creating remote registry client for image %q: %v", ref.Exact(), err)
+		return nil, err
+	}
+
+	result, err := manifestTransferManager.Transfer(ctx, ref.Registry, ref.RepositoryName(), dgst, func(transferCtx stdcontext.Context) (interface{}, error) {
+		manifest, _, err := client.PullManifest(transferCtx, ref.RepositoryName(), dgst.String())
+		if err != nil {
+			context.GetLogger(m.repo.ctx).Errorf("error pulling manifest for image %q: %v", ref.Exact(), err)
+			return nil, err
+		}
+		return manifest, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	manifest := result.(distribution.Manifest)
+
+	if err := m.verifyManifest(ctx, ref.RepositoryName(), dgst, manifest); err != nil {
+		return nil, err
+	}
+
+	childFetcher := func(childDigest digest.Digest) (distribution.Manifest, error) {
+		result, err := manifestTransferManager.Transfer(ctx, ref.Registry, ref.RepositoryName(), childDigest, func(transferCtx stdcontext.Context) (interface{}, error) {
+			childManifest, _, err := client.PullManifest(transferCtx, ref.RepositoryName(), childDigest.String())
+			if err != nil {
+				return nil, err
+			}
+			return childManifest, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return result.(distribution.Manifest), nil
+	}
+	if err := m.rememberLayers(childFetcher, manifest, dgst, ref); err != nil {
+		context.GetLogger(m.repo.ctx).Errorf("error caching layers of manifest %q: %v", dgst, err)
+	}
+
+	return manifest, nil
+}
+
+// rememberLayers records the child digests of manifest against the remote
+// repository named by ref in m.repo.cachedLayers, so subsequent blob
+// pullthrough requests know where to look. Manifest lists and OCI image
+// indexes are walked so every referenced platform manifest (and, in turn,
+// its layers) is cached as well; schema1 and schema2 manifests record
+// their own layers directly. fetchChild retrieves a child manifest by
+// digest from the same remote repository as manifest.
+func (m *pullthroughManifestService) rememberLayers(fetchChild func(digest.Digest) (distribution.Manifest, error), manifest distribution.Manifest, dgst digest.Digest, ref imageapi.DockerImageReference) error {
+	switch t := manifest.(type) {
+	case *manifestlist.DeserializedManifestList:
+		for _, d := range t.References() {
+			m.repo.rememberLayersOfManifestList(d.Digest, ref)
+
+			childManifest, err := fetchChild(d.Digest)
+			if err != nil {
+				context.GetLogger(m.repo.ctx).Errorf("error fetching child manifest %q of index %q: %v", d.Digest, dgst, err)
+				continue
+			}
+			if err := m.rememberLayers(fetchChild, childManifest, d.Digest, ref); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *schema1.SignedManifest:
+		layers := make([]distribution.Descriptor, 0, len(t.FSLayers))
+		for _, l := range t.FSLayers {
+			layers = append(layers, distribution.Descriptor{Digest: l.BlobSum})
+		}
+		m.repo.rememberLayersOfImage(layers, ref.Exact())
+		return nil
+	default:
+		m.repo.rememberLayersOfImage(manifest.References(), ref.Exact())
+		return nil
+	}
+}
+
+// Put stores manifest locally. Manifest lists and OCI image indexes are
+// rejected unless every platform-specific manifest they reference already
+// exists in the local manifest service, since the registry has no way to
+// pull through a partially-uploaded index on a later Get.
+func (m *pullthroughManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	if list, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		for _, d := range list.References() {
+			exists, err := m.ManifestService.Exists(ctx, d.Digest)
+			if err != nil {
+				return "", err
+			}
+			if !exists {
+				return "", fmt.Errorf("manifest list references manifest %q which does not exist locally", d.Digest)
+			}
+		}
+	}
+	return m.ManifestService.Put(ctx, manifest, options...)
+}
@@ -3,27 +3,79 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"os"
+	"sync"
 	"testing"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/configuration"
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema1"
+	registryclient "github.com/docker/distribution/registry/client"
 	"github.com/docker/distribution/registry/handlers"
 	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
 
-	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/fake"
-
 	"github.com/openshift/origin/pkg/client/testclient"
 	registrytest "github.com/openshift/origin/pkg/dockerregistry/testutil"
 	imagetest "github.com/openshift/origin/pkg/image/admission/testutil"
 	imageapi "github.com/openshift/origin/pkg/image/api"
 )
 
+// directRemoteRegistryClient is a RemoteRegistryClient that talks
+// straight to a known baseURL, bypassing DefaultRegistryClient and the
+// registry-hostname-to-env-var indirection it previously required. It
+// exists so tests can point pullthrough at an httptest server without
+// mutating global state.
+type directRemoteRegistryClient struct {
+	baseURL string
+}
+
+func (c *directRemoteRegistryClient) repository(ctx context.Context, repo string) (distribution.Repository, error) {
+	return registryclient.NewRepository(ctx, repo, c.baseURL, http.DefaultTransport)
+}
+
+func (c *directRemoteRegistryClient) PullManifest(ctx context.Context, repo, ref string) (distribution.Manifest, string, error) {
+	remoteRepo, err := c.repository(ctx, repo)
+	if err != nil {
+		return nil, "", err
+	}
+	manifests, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	dgst, err := digest.ParseDigest(ref)
+	if err != nil {
+		tagDescriptor, err := remoteRepo.Tags(ctx).Get(ctx, ref)
+		if err != nil {
+			return nil, "", err
+		}
+		dgst = tagDescriptor.Digest
+	}
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return nil, "", err
+	}
+	mediaType, _, err := manifest.Payload()
+	return manifest, mediaType, err
+}
+
+func (c *directRemoteRegistryClient) PullBlob(ctx context.Context, repo string, desc distribution.Descriptor) ([]byte, error) {
+	remoteRepo, err := c.repository(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	return remoteRepo.Blobs(ctx).Get(ctx, desc.Digest)
+}
+
+func (c *directRemoteRegistryClient) Ping(ctx context.Context) error {
+	_, err := c.repository(ctx, "")
+	return err
+}
+
 func TestPullthroughManifests(t *testing.T) {
 	ctx := context.Background()
 
@@ -38,14 +90,6 @@ func TestPullthroughManifests(t *testing.T) {
 	client := &testclient.Fake{}
 	client.AddReactor("get", "images", registrytest.GetFakeImageGetHandler(t, *testImage))
 
-	// TODO: get rid of those nasty global vars
-	backupRegistryClient := DefaultRegistryClient
-	DefaultRegistryClient = makeFakeRegistryClient(client, fake.NewSimpleClientset())
-	defer func() {
-		// set it back once this test finishes to make other unit tests working again
-		DefaultRegistryClient = backupRegistryClient
-	}()
-
 	// pullthrough middleware will attempt to pull from this registry instance
 	remoteRegistryApp := handlers.NewApp(ctx, &configuration.Configuration{
 		Loglevel: "debug",
@@ -74,7 +118,10 @@ func TestPullthroughManifests(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error parsing server url: %v", err)
 	}
-	os.Setenv("DOCKER_REGISTRY_URL", serverURL.Host)
+	RegisterRemoteRegistryClient(serverURL.Host, func(hostname string, insecure bool) (RemoteRegistryClient, error) {
+		return &directRemoteRegistryClient{baseURL: remoteRegistryServer.URL}, nil
+	})
+	defer RegisterRemoteRegistryClient(serverURL.Host, nil)
 	testImage.DockerImageReference = fmt.Sprintf("%s/%s@%s", serverURL.Host, "user/app", testImage.Name)
 
 	testImageStream := registrytest.TestNewImageStreamObject("user", "app", "latest", testImage.Name, testImage.DockerImageReference)
@@ -175,6 +222,349 @@ func TestPullthroughManifests(t *testing.T) {
 	}
 }
 
+// TestPullthroughManifestsPinnedDigestMismatch verifies that when the
+// image stream backing a repository is pinned to a digest that
+// disagrees with the manifest actually retrieved from the remote
+// registry, Get fails with distribution.ErrManifestUnverified instead of
+// serving the mismatched manifest. repo.cachedLayers is left nil: since
+// rememberLayers is only reached after verifyManifest succeeds, a nil
+// cache surviving the call untouched (no panic) is itself proof that the
+// mismatched manifest's layers were never recorded.
+func TestPullthroughManifestsPinnedDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	installFakeAccessController(t)
+
+	testImage, err := registrytest.NewImageForManifest("user/app", registrytest.SampleImageManifestSchema1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testImage.DockerImageManifest = ""
+
+	client := &testclient.Fake{}
+	client.AddReactor("get", "images", registrytest.GetFakeImageGetHandler(t, *testImage))
+
+	remoteRegistryApp := handlers.NewApp(ctx, &configuration.Configuration{
+		Loglevel: "debug",
+		Auth: map[string]configuration.Parameters{
+			fakeAuthorizerName: {"realm": fakeAuthorizerName},
+		},
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"cache": configuration.Parameters{
+				"blobdescriptor": "inmemory",
+			},
+			"delete": configuration.Parameters{
+				"enabled": true,
+			},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"registry":   {{Name: "openshift"}},
+			"repository": {{Name: "openshift"}},
+			"storage":    {{Name: "openshift"}},
+		},
+	})
+	remoteRegistryServer := httptest.NewServer(remoteRegistryApp)
+	defer remoteRegistryServer.Close()
+
+	serverURL, err := url.Parse(remoteRegistryServer.URL)
+	if err != nil {
+		t.Fatalf("error parsing server url: %v", err)
+	}
+	RegisterRemoteRegistryClient(serverURL.Host, func(hostname string, insecure bool) (RemoteRegistryClient, error) {
+		return &directRemoteRegistryClient{baseURL: remoteRegistryServer.URL}, nil
+	})
+	defer RegisterRemoteRegistryClient(serverURL.Host, nil)
+	testImage.DockerImageReference = fmt.Sprintf("%s/%s@%s", serverURL.Host, "user/app", testImage.Name)
+
+	signedManifest := &schema1.SignedManifest{}
+	if err := json.Unmarshal([]byte(etcdManifest), signedManifest); err != nil {
+		t.Fatalf("error unmarshaling signed manifest: %v", err)
+	}
+
+	remoteRepo, err := registryclient.NewRepository(ctx, "user/app", remoteRegistryServer.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("error creating remote repository client: %v", err)
+	}
+	remoteManifests, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatalf("error creating remote manifest service: %v", err)
+	}
+	if _, err := remoteManifests.Put(ctx, signedManifest); err != nil {
+		t.Fatalf("error pushing manifest to remote registry: %v", err)
+	}
+
+	testImageStream := registrytest.TestNewImageStreamObject("user", "app", "latest", testImage.Name, testImage.DockerImageReference)
+	if testImageStream.Annotations == nil {
+		testImageStream.Annotations = make(map[string]string)
+	}
+	testImageStream.Annotations[imageapi.InsecureRepositoryAnnotation] = "true"
+	testImageStream.Annotations[ImagePinnedDigestAnnotation] = unknownBlobDigest.String()
+	client.AddReactor("get", "imagestreams", imagetest.GetFakeImageStreamGetHandler(t, *testImageStream))
+
+	ptms := &pullthroughManifestService{
+		ManifestService: unknownRevisionManifestService{newTestManifestService(nil)},
+		repo: &repository{
+			ctx:              ctx,
+			namespace:        "user",
+			name:             "app",
+			pullthrough:      true,
+			registryOSClient: client,
+		},
+	}
+
+	_, err = ptms.Get(ctx, etcdDigest)
+	if _, ok := err.(distribution.ErrManifestUnverified); !ok {
+		t.Fatalf("expected distribution.ErrManifestUnverified for a pin-mismatched manifest, got %#+v", err)
+	}
+}
+
+// countingRemoteRegistryClient wraps a RemoteRegistryClient and records
+// how many times PullManifest was asked for each ref, so a test can
+// verify which manifests were actually fetched from the remote without
+// reaching into cachedLayers' internals.
+type countingRemoteRegistryClient struct {
+	inner RemoteRegistryClient
+
+	mu            sync.Mutex
+	manifestCalls map[string]int
+}
+
+func (c *countingRemoteRegistryClient) PullManifest(ctx context.Context, repo, ref string) (distribution.Manifest, string, error) {
+	c.mu.Lock()
+	c.manifestCalls[ref]++
+	c.mu.Unlock()
+	return c.inner.PullManifest(ctx, repo, ref)
+}
+
+func (c *countingRemoteRegistryClient) PullBlob(ctx context.Context, repo string, desc distribution.Descriptor) ([]byte, error) {
+	return c.inner.PullBlob(ctx, repo, desc)
+}
+
+func (c *countingRemoteRegistryClient) Ping(ctx context.Context) error {
+	return c.inner.Ping(ctx)
+}
+
+// unknownRevisionManifestService reports a manifest missing from the
+// wrapped testManifestService as distribution.ErrManifestUnknownRevision
+// instead of distribution.ErrBlobUnknown, so that
+// pullthroughManifestService.Get treats it as unknown locally and pulls
+// it through from the remote registry.
+type unknownRevisionManifestService struct {
+	*testManifestService
+}
+
+func (s unknownRevisionManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, err := s.testManifestService.Get(ctx, dgst, options...)
+	if err == distribution.ErrBlobUnknown {
+		return nil, distribution.ErrManifestUnknownRevision{Revision: dgst}
+	}
+	return manifest, err
+}
+
+// TestPullthroughManifestsManifestList verifies that Get on a manifest
+// list (or OCI image index) digest not known locally pulls the list
+// through from the remote registry, returns it unmodified, and resolves
+// every platform-specific manifest it references so their layers get
+// cached, the same way TestPullthroughManifests exercises a plain
+// manifest.
+func TestPullthroughManifestsManifestList(t *testing.T) {
+	ctx := context.Background()
+
+	installFakeAccessController(t)
+
+	childManifest := &schema1.SignedManifest{}
+	if err := json.Unmarshal([]byte(etcdManifest), childManifest); err != nil {
+		t.Fatalf("error unmarshaling child manifest: %v", err)
+	}
+
+	indexManifest, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{
+		{
+			Descriptor: distribution.Descriptor{Digest: etcdDigest, MediaType: schema1.MediaTypeSignedManifest},
+			Platform:   manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+		},
+		{
+			Descriptor: distribution.Descriptor{Digest: etcdDigest, MediaType: schema1.MediaTypeSignedManifest},
+			Platform:   manifestlist.PlatformSpec{Architecture: "arm64", OS: "linux"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error building manifest list: %v", err)
+	}
+	_, indexPayload, err := indexManifest.Payload()
+	if err != nil {
+		t.Fatalf("error marshaling manifest list: %v", err)
+	}
+	indexDigest := digest.FromBytes(indexPayload)
+
+	testImage, err := registrytest.NewImageForManifest("user/app", string(indexPayload), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testImage.DockerImageManifest = ""
+
+	client := &testclient.Fake{}
+	client.AddReactor("get", "images", registrytest.GetFakeImageGetHandler(t, *testImage))
+
+	remoteRegistryApp := handlers.NewApp(ctx, &configuration.Configuration{
+		Loglevel: "debug",
+		Auth: map[string]configuration.Parameters{
+			fakeAuthorizerName: {"realm": fakeAuthorizerName},
+		},
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"cache": configuration.Parameters{
+				"blobdescriptor": "inmemory",
+			},
+			"delete": configuration.Parameters{
+				"enabled": true,
+			},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"registry":   {{Name: "openshift"}},
+			"repository": {{Name: "openshift"}},
+			"storage":    {{Name: "openshift"}},
+		},
+	})
+	remoteRegistryServer := httptest.NewServer(remoteRegistryApp)
+	defer remoteRegistryServer.Close()
+
+	serverURL, err := url.Parse(remoteRegistryServer.URL)
+	if err != nil {
+		t.Fatalf("error parsing server url: %v", err)
+	}
+	counting := &countingRemoteRegistryClient{
+		inner:         &directRemoteRegistryClient{baseURL: remoteRegistryServer.URL},
+		manifestCalls: make(map[string]int),
+	}
+	RegisterRemoteRegistryClient(serverURL.Host, func(hostname string, insecure bool) (RemoteRegistryClient, error) {
+		return counting, nil
+	})
+	defer RegisterRemoteRegistryClient(serverURL.Host, nil)
+	testImage.DockerImageReference = fmt.Sprintf("%s/%s@%s", serverURL.Host, "user/app", testImage.Name)
+
+	testImageStream := registrytest.TestNewImageStreamObject("user", "app", "latest", testImage.Name, testImage.DockerImageReference)
+	if testImageStream.Annotations == nil {
+		testImageStream.Annotations = make(map[string]string)
+	}
+	testImageStream.Annotations[imageapi.InsecureRepositoryAnnotation] = "true"
+	client.AddReactor("get", "imagestreams", imagetest.GetFakeImageStreamGetHandler(t, *testImageStream))
+
+	remoteRepo, err := registryclient.NewRepository(ctx, "user/app", remoteRegistryServer.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("error creating remote repository client: %v", err)
+	}
+	remoteManifests, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatalf("error creating remote manifest service: %v", err)
+	}
+	if _, err := remoteManifests.Put(ctx, childManifest); err != nil {
+		t.Fatalf("error pushing child manifest to remote registry: %v", err)
+	}
+	if _, err := remoteManifests.Put(ctx, indexManifest); err != nil {
+		t.Fatalf("error pushing manifest list to remote registry: %v", err)
+	}
+
+	localManifestService := newTestManifestService(nil)
+	cachedLayers, err := newDigestToRepositoryCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptms := &pullthroughManifestService{
+		ManifestService: unknownRevisionManifestService{localManifestService},
+		repo: &repository{
+			ctx:              ctx,
+			namespace:        "user",
+			name:             "app",
+			pullthrough:      true,
+			cachedLayers:     cachedLayers,
+			registryOSClient: client,
+		},
+	}
+
+	result, err := ptms.Get(ctx, indexDigest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resultList, ok := result.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		t.Fatalf("expected a *manifestlist.DeserializedManifestList, got %T", result)
+	}
+	_, resultPayload, err := resultList.Payload()
+	if err != nil {
+		t.Fatalf("error marshaling returned manifest list: %v", err)
+	}
+	if string(resultPayload) != string(indexPayload) {
+		t.Fatalf("expected the manifest list to be returned unmodified")
+	}
+
+	if got := counting.manifestCalls[indexDigest.String()]; got != 1 {
+		t.Errorf("expected the manifest list itself to be pulled once, got %d", got)
+	}
+	if got := counting.manifestCalls[etcdDigest.String()]; got != len(indexManifest.References()) {
+		t.Errorf("expected each of the %d platform-specific manifests to be pulled through so its layers get cached, got %d", len(indexManifest.References()), got)
+	}
+}
+
+// TestPullthroughManifestsPutManifestList verifies that a manifest list
+// (or, equivalently, an OCI image index) can only be stored once every
+// platform-specific manifest it references already exists in the local
+// manifest service.
+func TestPullthroughManifestsPutManifestList(t *testing.T) {
+	ctx := context.Background()
+
+	childManifest := &schema1.SignedManifest{}
+	if err := json.Unmarshal([]byte(etcdManifest), childManifest); err != nil {
+		t.Fatal(err)
+	}
+
+	localManifestService := newTestManifestService(map[digest.Digest]distribution.Manifest{
+		etcdDigest: childManifest,
+	})
+
+	ptms := &pullthroughManifestService{
+		ManifestService: localManifestService,
+		repo: &repository{
+			ctx:         ctx,
+			namespace:   "user",
+			name:        "app",
+			pullthrough: true,
+		},
+	}
+
+	incomplete, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{
+		{
+			Descriptor: distribution.Descriptor{Digest: etcdDigest, MediaType: schema1.MediaTypeSignedManifest},
+			Platform:   manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+		},
+		{
+			Descriptor: distribution.Descriptor{Digest: unknownBlobDigest, MediaType: schema1.MediaTypeSignedManifest},
+			Platform:   manifestlist.PlatformSpec{Architecture: "arm64", OS: "linux"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ptms.Put(ctx, incomplete); err == nil {
+		t.Fatalf("expected Put to reject a manifest list referencing a manifest missing locally")
+	}
+
+	complete, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{
+		{
+			Descriptor: distribution.Descriptor{Digest: etcdDigest, MediaType: schema1.MediaTypeSignedManifest},
+			Platform:   manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ptms.Put(ctx, complete); err != nil {
+		t.Fatalf("unexpected error storing manifest list with only locally-known references: %v", err)
+	}
+}
+
 type testManifestService struct {
 	data  map[digest.Digest]distribution.Manifest
 	calls map[string]int
@@ -210,7 +600,13 @@ func (t *testManifestService) Get(ctx context.Context, dgst digest.Digest, optio
 
 func (t *testManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	t.calls["Put"]++
-	return "", fmt.Errorf("method not implemented")
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return "", err
+	}
+	dgst := digest.FromBytes(payload)
+	t.data[dgst] = manifest
+	return dgst, nil
 }
 
 func (t *testManifestService) Delete(ctx context.Context, dgst digest.Digest) error {
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+
+	"github.com/openshift/origin/pkg/dockerregistry/server/ociclient"
+)
+
+// RemoteRegistryClient is the interface pullthrough code uses to reach a
+// remote registry. It exists so that tests can inject a fake
+// implementation instead of relying on a real DefaultRegistryClient
+// backed by an environment variable and a package-level swap, and so
+// operators can choose a different implementation per remote registry
+// host (for instance, one that negotiates Accept headers differently).
+type RemoteRegistryClient interface {
+	// PullManifest fetches the manifest identified by ref (a tag or a
+	// digest) from repo, along with the media type the server actually
+	// served it as.
+	PullManifest(ctx context.Context, repo, ref string) (manifest distribution.Manifest, mediaType string, err error)
+	// PullBlob fetches the blob identified by dgst from repo.
+	PullBlob(ctx context.Context, repo string, dgst distribution.Descriptor) ([]byte, error)
+	// Ping verifies the remote registry is reachable and speaks a
+	// protocol this client understands.
+	Ping(ctx context.Context) error
+}
+
+// RemoteRegistryClientFactory builds a RemoteRegistryClient for talking
+// to a specific registry host.
+type RemoteRegistryClientFactory func(hostname string, insecure bool) (RemoteRegistryClient, error)
+
+var (
+	remoteRegistryClientFactoriesMu sync.RWMutex
+	// remoteRegistryClientFactories maps a registry hostname to the
+	// factory that should be used to build clients for it, letting
+	// operators opt specific remotes into an alternate implementation
+	// (e.g. one tolerant of registries that mishandle certain Accept
+	// headers). Hosts with no entry use defaultRemoteRegistryClientFactory.
+	remoteRegistryClientFactories = map[string]RemoteRegistryClientFactory{}
+)
+
+// RegisterRemoteRegistryClient installs factory as the client builder
+// used for hostname. Passing a nil factory removes any override,
+// reverting hostname to the default implementation.
+func RegisterRemoteRegistryClient(hostname string, factory RemoteRegistryClientFactory) {
+	remoteRegistryClientFactoriesMu.Lock()
+	defer remoteRegistryClientFactoriesMu.Unlock()
+	if factory == nil {
+		delete(remoteRegistryClientFactories, hostname)
+		return
+	}
+	remoteRegistryClientFactories[hostname] = factory
+}
+
+// newRemoteRegistryClient builds a RemoteRegistryClient for hostname,
+// using whatever factory was registered for it, or the default
+// docker/distribution-based implementation otherwise.
+func newRemoteRegistryClient(hostname string, insecure bool) (RemoteRegistryClient, error) {
+	remoteRegistryClientFactoriesMu.RLock()
+	factory, ok := remoteRegistryClientFactories[hostname]
+	remoteRegistryClientFactoriesMu.RUnlock()
+	if ok {
+		return factory(hostname, insecure)
+	}
+	return defaultRemoteRegistryClientFactory(hostname, insecure)
+}
+
+// defaultRemoteRegistryClientFactory adapts the existing
+// docker/distribution-based retriever (DefaultRegistryClient.Connect)
+// to the RemoteRegistryClient interface.
+func defaultRemoteRegistryClientFactory(hostname string, insecure bool) (RemoteRegistryClient, error) {
+	return &distributionRemoteRegistryClient{hostname: hostname, insecure: insecure}, nil
+}
+
+// distributionRemoteRegistryClient implements RemoteRegistryClient on
+// top of the existing DefaultRegistryClient connection helper used by
+// pullthroughManifestService prior to this abstraction.
+type distributionRemoteRegistryClient struct {
+	hostname string
+	insecure bool
+}
+
+func (c *distributionRemoteRegistryClient) repository(ctx context.Context, repo string) (distribution.Repository, error) {
+	retriever := DefaultRegistryClient.Connect()
+	return retriever.Repository(ctx, c.hostname, repo, c.insecure)
+}
+
+func (c *distributionRemoteRegistryClient) PullManifest(ctx context.Context, repo, ref string) (distribution.Manifest, string, error) {
+	remoteRepo, err := c.repository(ctx, repo)
+	if err != nil {
+		return nil, "", err
+	}
+	manifests, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dgst, err := digest.ParseDigest(ref)
+	if err != nil {
+		// ref isn't a digest; resolve it as a tag first.
+		tagDescriptor, err := remoteRepo.Tags(ctx).Get(ctx, ref)
+		if err != nil {
+			return nil, "", err
+		}
+		dgst = tagDescriptor.Digest
+	}
+
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return nil, "", err
+	}
+	mediaType, _, err := manifest.Payload()
+	if err != nil {
+		return nil, "", err
+	}
+	return manifest, mediaType, nil
+}
+
+func (c *distributionRemoteRegistryClient) PullBlob(ctx context.Context, repo string, desc distribution.Descriptor) ([]byte, error) {
+	remoteRepo, err := c.repository(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	return remoteRepo.Blobs(ctx).Get(ctx, desc.Digest)
+}
+
+func (c *distributionRemoteRegistryClient) Ping(ctx context.Context) error {
+	_, err := c.repository(ctx, "")
+	return err
+}
+
+// ociRemoteRegistryClient adapts the lightweight OCI distribution-spec
+// HTTP client to the RemoteRegistryClient interface, for remotes that
+// should be talked to directly rather than through the heavier
+// docker/distribution client machinery.
+type ociRemoteRegistryClient struct {
+	client *ociclient.Client
+}
+
+// NewOCIRemoteRegistryClient builds a RemoteRegistryClient that speaks
+// the OCI distribution spec directly over HTTP(S) to hostname.
+func NewOCIRemoteRegistryClient(hostname string, insecure bool) (RemoteRegistryClient, error) {
+	c, err := ociclient.New(hostname, insecure)
+	if err != nil {
+		return nil, err
+	}
+	return &ociRemoteRegistryClient{client: c}, nil
+}
+
+func (c *ociRemoteRegistryClient) PullManifest(ctx context.Context, repo, ref string) (distribution.Manifest, string, error) {
+	return c.client.GetManifest(ctx, repo, ref)
+}
+
+func (c *ociRemoteRegistryClient) PullBlob(ctx context.Context, repo string, desc distribution.Descriptor) ([]byte, error) {
+	return c.client.GetBlob(ctx, repo, desc.Digest)
+}
+
+func (c *ociRemoteRegistryClient) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx)
+}
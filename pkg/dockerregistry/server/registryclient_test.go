@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+)
+
+type fakeRemoteRegistryClient struct{}
+
+func (fakeRemoteRegistryClient) PullManifest(ctx context.Context, repo, ref string) (distribution.Manifest, string, error) {
+	return nil, "", nil
+}
+func (fakeRemoteRegistryClient) PullBlob(ctx context.Context, repo string, desc distribution.Descriptor) ([]byte, error) {
+	return nil, nil
+}
+func (fakeRemoteRegistryClient) Ping(ctx context.Context) error { return nil }
+
+func TestRegisterRemoteRegistryClientOverridesFactory(t *testing.T) {
+	const host = "registry.example.com"
+
+	built := false
+	RegisterRemoteRegistryClient(host, func(hostname string, insecure bool) (RemoteRegistryClient, error) {
+		if hostname != host {
+			t.Errorf("expected hostname %q, got %q", host, hostname)
+		}
+		built = true
+		return fakeRemoteRegistryClient{}, nil
+	})
+	defer RegisterRemoteRegistryClient(host, nil)
+
+	client, err := newRemoteRegistryClient(host, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !built {
+		t.Fatalf("expected the registered factory to be used")
+	}
+	if _, ok := client.(fakeRemoteRegistryClient); !ok {
+		t.Fatalf("expected the registered fake client, got %T", client)
+	}
+
+	RegisterRemoteRegistryClient(host, nil)
+	client, err = newRemoteRegistryClient(host, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := client.(*distributionRemoteRegistryClient); !ok {
+		t.Fatalf("expected the default client after deregistering, got %T", client)
+	}
+}
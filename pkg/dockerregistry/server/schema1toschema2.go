@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+// schema2ConfigMediaType is the media type used for the synthesized
+// image config blob stored alongside a converted manifest.
+const schema2ConfigMediaType = "application/vnd.docker.container.image.v1+json"
+
+// convertedManifestCache remembers, for a given (source digest, target
+// media type, repository) triple, the schema2 manifest already
+// synthesized for it, so repeated requests for the same schema1 image in
+// the same repository don't redo the conversion and re-store the same
+// config blob.
+var convertedManifestCache sync.Map // map[convertedManifestKey]distribution.Manifest
+
+type convertedManifestKey struct {
+	source     digest.Digest
+	mediaType  string
+	repository string
+}
+
+// convertToRequestedSchema converts manifest to the client's preferred
+// media type, if that's possible and necessary. Today the only
+// conversion supported is schema1 (as stored on disk or returned by a
+// pullthrough remote) to schema2, performed when the request's Accept
+// header - surfaced here via distribution.WithManifestMediaTypes -
+// prefers schema2 over schema1. It returns ok=false when no conversion
+// applies, leaving the original manifest untouched.
+func (m *pullthroughManifestService) convertToRequestedSchema(ctx context.Context, dgst digest.Digest, manifest distribution.Manifest, options []distribution.ManifestServiceOption) (distribution.Manifest, bool, error) {
+	signed, ok := manifest.(*schema1.SignedManifest)
+	if !ok {
+		return nil, false, nil
+	}
+	if !prefersSchema2(options) {
+		return nil, false, nil
+	}
+
+	key := convertedManifestKey{source: dgst, mediaType: schema2.MediaTypeManifest, repository: m.repo.Named().Name()}
+	if cached, ok := convertedManifestCache.Load(key); ok {
+		return cached.(distribution.Manifest), true, nil
+	}
+
+	converted, err := m.convertSchema1ToSchema2(ctx, signed)
+	if err != nil {
+		context.GetLogger(m.repo.ctx).Errorf("error converting schema1 manifest %q to schema2: %v", dgst, err)
+		return nil, false, err
+	}
+
+	convertedManifestCache.Store(key, converted)
+	return converted, true, nil
+}
+
+// prefersSchema2 reports whether any of options asks for the schema2
+// media type ahead of schema1.
+func prefersSchema2(options []distribution.ManifestServiceOption) bool {
+	for _, option := range options {
+		mediaTypes, ok := option.(distribution.WithManifestMediaTypes)
+		if !ok {
+			continue
+		}
+		for _, mt := range mediaTypes.MediaTypes {
+			if mt == schema2.MediaTypeManifest {
+				return true
+			}
+			if mt == schema1.MediaTypeSignedManifest {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// convertSchema1ToSchema2 synthesizes a schema2 manifest and image
+// config from a schema1 signed manifest. The config is derived from the
+// v1Compatibility history, merged oldest-to-newest so the top-most
+// (most recent) entry's architecture, os, config and container_config
+// win; the rootfs diff_ids fall back to the schema1 blobSums, since
+// schema1 carries no diff_id information. schema2.NewManifestBuilder
+// stores the synthesized config in the repository's blob store itself
+// and records its descriptor as the schema2 manifest's Config
+// reference.
+func (m *pullthroughManifestService) convertSchema1ToSchema2(ctx context.Context, signed *schema1.SignedManifest) (*schema2.DeserializedManifest, error) {
+	config, err := mergeV1CompatibilityConfig(signed.History)
+	if err != nil {
+		return nil, err
+	}
+
+	config.RootFS = &rootFS{Type: "layers"}
+	for i := len(signed.FSLayers) - 1; i >= 0; i-- {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, signed.FSLayers[i].BlobSum)
+	}
+
+	configPayload, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := schema2.NewManifestBuilder(m.repo.Blobs(ctx), configPayload)
+	for i := len(signed.FSLayers) - 1; i >= 0; i-- {
+		if err := builder.AppendReference(distribution.Descriptor{
+			MediaType: schema2.MediaTypeLayer,
+			Digest:    signed.FSLayers[i].BlobSum,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	built, err := builder.Build(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deserialized, ok := built.(*schema2.DeserializedManifest)
+	if !ok {
+		return nil, errUnexpectedManifestType{built}
+	}
+
+	return deserialized, nil
+}
+
+// schema2ImageConfig is the subset of the OCI/Docker image config JSON
+// that can be derived from schema1 v1Compatibility history.
+type schema2ImageConfig struct {
+	Architecture    string          `json:"architecture,omitempty"`
+	OS              string          `json:"os,omitempty"`
+	Config          json.RawMessage `json:"config,omitempty"`
+	ContainerConfig json.RawMessage `json:"container_config,omitempty"`
+	RootFS          *rootFS         `json:"rootfs,omitempty"`
+	History         []historyEntry  `json:"history,omitempty"`
+}
+
+type rootFS struct {
+	Type    string          `json:"type"`
+	DiffIDs []digest.Digest `json:"diff_ids"`
+}
+
+type historyEntry struct {
+	Created string `json:"created,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// v1Compatibility is the subset of fields present in each schema1
+// history entry's v1Compatibility JSON blob that are needed to
+// reconstruct a schema2 image config.
+type v1Compatibility struct {
+	Created         string          `json:"created,omitempty"`
+	Comment         string          `json:"comment,omitempty"`
+	Architecture    string          `json:"architecture,omitempty"`
+	OS              string          `json:"os,omitempty"`
+	Config          json.RawMessage `json:"config,omitempty"`
+	ContainerConfig json.RawMessage `json:"container_config,omitempty"`
+}
+
+// mergeV1CompatibilityConfig walks history oldest-to-newest (schema1
+// history is ordered most-recent first), accumulating a history entry
+// per layer and letting each entry's architecture/os/config/
+// container_config override the ones before it, so the final result
+// reflects the top-most (most recent) layer's values.
+func mergeV1CompatibilityConfig(history []schema1.History) (*schema2ImageConfig, error) {
+	config := &schema2ImageConfig{}
+	for i := len(history) - 1; i >= 0; i-- {
+		var v1c v1Compatibility
+		if err := json.Unmarshal([]byte(history[i].V1Compatibility), &v1c); err != nil {
+			return nil, err
+		}
+		config.History = append(config.History, historyEntry{Created: v1c.Created, Comment: v1c.Comment})
+		if v1c.Architecture != "" {
+			config.Architecture = v1c.Architecture
+		}
+		if v1c.OS != "" {
+			config.OS = v1c.OS
+		}
+		if len(v1c.Config) > 0 {
+			config.Config = v1c.Config
+		}
+		if len(v1c.ContainerConfig) > 0 {
+			config.ContainerConfig = v1c.ContainerConfig
+		}
+	}
+	return config, nil
+}
+
+// errUnexpectedManifestType is returned when schema2.ManifestBuilder
+// produces something other than *schema2.DeserializedManifest, which
+// should never happen but is cheaper to report than to panic on.
+type errUnexpectedManifestType struct {
+	manifest distribution.Manifest
+}
+
+func (e errUnexpectedManifestType) Error() string {
+	return "schema2 manifest builder returned unexpected manifest type"
+}
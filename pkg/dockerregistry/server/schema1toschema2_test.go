@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/configuration"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	registryclient "github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/handlers"
+	_ "github.com/docker/distribution/registry/storage/driver/inmemory"
+)
+
+func TestMergeV1CompatibilityConfig(t *testing.T) {
+	signedManifest := &schema1.SignedManifest{}
+	if err := json.Unmarshal([]byte(etcdManifest), signedManifest); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := mergeV1CompatibilityConfig(signedManifest.History)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if config.Architecture != "amd64" {
+		t.Errorf("expected architecture %q, got %q", "amd64", config.Architecture)
+	}
+	if config.OS != "linux" {
+		t.Errorf("expected os %q, got %q", "linux", config.OS)
+	}
+	if len(config.Config) == 0 {
+		t.Errorf("expected top-most config to be preserved")
+	}
+	if len(config.ContainerConfig) == 0 {
+		t.Errorf("expected top-most container_config to be preserved")
+	}
+	if len(config.History) != len(signedManifest.History) {
+		t.Errorf("expected %d history entries, got %d", len(signedManifest.History), len(config.History))
+	}
+
+	var topMost struct {
+		Entrypoint []string `json:"Entrypoint"`
+	}
+	if err := json.Unmarshal(config.Config, &topMost); err != nil {
+		t.Fatalf("unexpected error unmarshaling merged config: %v", err)
+	}
+	if len(topMost.Entrypoint) != 1 || topMost.Entrypoint[0] != "/etcd" {
+		t.Errorf("expected entrypoint [/etcd], got %v", topMost.Entrypoint)
+	}
+}
+
+// TestConvertSchema1ToSchema2 drives the conversion with the etcdManifest
+// fixture against a real (local, non-pullthrough) blob store, asserting
+// the result is a well-formed schema2 manifest whose config blob was
+// actually stored and can be fetched back out.
+func TestConvertSchema1ToSchema2(t *testing.T) {
+	ctx := context.Background()
+
+	localRegistryApp := handlers.NewApp(ctx, &configuration.Configuration{
+		Loglevel: "debug",
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"cache": configuration.Parameters{
+				"blobdescriptor": "inmemory",
+			},
+		},
+	})
+	localRegistryServer := httptest.NewServer(localRegistryApp)
+	defer localRegistryServer.Close()
+
+	localRepo, err := registryclient.NewRepository(ctx, "user/app", localRegistryServer.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("error creating local repository client: %v", err)
+	}
+
+	signedManifest := &schema1.SignedManifest{}
+	if err := json.Unmarshal([]byte(etcdManifest), signedManifest); err != nil {
+		t.Fatal(err)
+	}
+
+	ptms := &pullthroughManifestService{
+		repo: &repository{Repository: localRepo, ctx: ctx, namespace: "user", name: "app"},
+	}
+
+	converted, err := ptms.convertSchema1ToSchema2(ctx, signedManifest)
+	if err != nil {
+		t.Fatalf("unexpected error converting manifest: %v", err)
+	}
+
+	mediaType, payload, err := converted.Payload()
+	if err != nil {
+		t.Fatalf("unexpected error marshaling converted manifest: %v", err)
+	}
+	if mediaType != schema2.MediaTypeManifest {
+		t.Errorf("expected media type %q, got %q", schema2.MediaTypeManifest, mediaType)
+	}
+	if len(payload) == 0 {
+		t.Errorf("expected a non-empty schema2 payload")
+	}
+	if converted.Config.Digest == "" {
+		t.Fatalf("expected the converted manifest to reference a config blob")
+	}
+
+	configPayload, err := localRepo.Blobs(ctx).Get(ctx, converted.Config.Digest)
+	if err != nil {
+		t.Fatalf("expected the config blob to be fetchable locally, got %v", err)
+	}
+
+	var config schema2ImageConfig
+	if err := json.Unmarshal(configPayload, &config); err != nil {
+		t.Fatalf("unexpected error unmarshaling config blob: %v", err)
+	}
+	if config.Architecture != "amd64" {
+		t.Errorf("expected architecture %q, got %q", "amd64", config.Architecture)
+	}
+}
+
+func TestPrefersSchema2(t *testing.T) {
+	if prefersSchema2(nil) {
+		t.Errorf("expected no preference without options")
+	}
+
+	preferSchema2 := distribution.WithManifestMediaTypes([]string{schema2.MediaTypeManifest, schema1.MediaTypeSignedManifest})
+	if !prefersSchema2([]distribution.ManifestServiceOption{preferSchema2}) {
+		t.Errorf("expected schema2 to be preferred when listed before schema1")
+	}
+
+	preferSchema1 := distribution.WithManifestMediaTypes([]string{schema1.MediaTypeSignedManifest, schema2.MediaTypeManifest})
+	if prefersSchema2([]distribution.ManifestServiceOption{preferSchema1}) {
+		t.Errorf("expected schema1 to be preferred when listed first")
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/openshift/origin/pkg/dockerregistry/server/xfer"
+)
+
+// Environment variables an operator can set to tune how many concurrent
+// pullthrough transfers manifestTransferManager and blobTransferManager
+// allow against a remote registry or repository, and how failed
+// transfers are retried.
+const (
+	envMaxParallelPerRemote = "REGISTRY_MIDDLEWARE_PULLTHROUGH_MAXPARALLELPERREMOTE"
+	envMaxParallelPerRepo   = "REGISTRY_MIDDLEWARE_PULLTHROUGH_MAXPARALLELPERREPO"
+	envRetryCount           = "REGISTRY_MIDDLEWARE_PULLTHROUGH_RETRYCOUNT"
+	envInitialBackoff       = "REGISTRY_MIDDLEWARE_PULLTHROUGH_INITIALBACKOFF"
+)
+
+// transferConfigFromEnv builds the xfer.Config pullthrough manifest and
+// blob fetches run under. Any of the variables above that is unset or
+// fails to parse falls back to the corresponding xfer.DefaultConfig
+// value, so an operator can tune one knob at a time.
+func transferConfigFromEnv() xfer.Config {
+	config := xfer.DefaultConfig()
+
+	if v, ok := envInt(envMaxParallelPerRemote); ok {
+		config.MaxParallelPerRemote = v
+	}
+	if v, ok := envInt(envMaxParallelPerRepo); ok {
+		config.MaxParallelPerRepo = v
+	}
+	if v, ok := envInt(envRetryCount); ok {
+		config.RetryCount = v
+	}
+	if v, ok := os.LookupEnv(envInitialBackoff); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			config.InitialBackoff = d
+		}
+	}
+
+	return config
+}
+
+// envInt reads name as an integer, returning ok=false if it is unset or
+// not a valid integer.
+func envInt(name string) (int, bool) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/openshift/origin/pkg/dockerregistry/server/xfer"
+)
+
+func TestTransferConfigFromEnv(t *testing.T) {
+	for _, name := range []string{envMaxParallelPerRemote, envMaxParallelPerRepo, envRetryCount, envInitialBackoff} {
+		os.Unsetenv(name)
+	}
+
+	if got, want := transferConfigFromEnv(), xfer.DefaultConfig(); got != want {
+		t.Errorf("expected the default config with no environment variables set, got %+v", got)
+	}
+
+	os.Setenv(envMaxParallelPerRemote, "10")
+	os.Setenv(envMaxParallelPerRepo, "4")
+	os.Setenv(envRetryCount, "5")
+	os.Setenv(envInitialBackoff, "50ms")
+	defer func() {
+		for _, name := range []string{envMaxParallelPerRemote, envMaxParallelPerRepo, envRetryCount, envInitialBackoff} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	config := transferConfigFromEnv()
+	if config.MaxParallelPerRemote != 10 {
+		t.Errorf("expected MaxParallelPerRemote 10, got %d", config.MaxParallelPerRemote)
+	}
+	if config.MaxParallelPerRepo != 4 {
+		t.Errorf("expected MaxParallelPerRepo 4, got %d", config.MaxParallelPerRepo)
+	}
+	if config.RetryCount != 5 {
+		t.Errorf("expected RetryCount 5, got %d", config.RetryCount)
+	}
+	if config.InitialBackoff != 50*time.Millisecond {
+		t.Errorf("expected InitialBackoff 50ms, got %v", config.InitialBackoff)
+	}
+}
+
+func TestTransferConfigFromEnvIgnoresInvalidValues(t *testing.T) {
+	os.Setenv(envMaxParallelPerRemote, "not-a-number")
+	os.Setenv(envInitialBackoff, "not-a-duration")
+	defer os.Unsetenv(envMaxParallelPerRemote)
+	defer os.Unsetenv(envInitialBackoff)
+
+	config := transferConfigFromEnv()
+	defaults := xfer.DefaultConfig()
+	if config.MaxParallelPerRemote != defaults.MaxParallelPerRemote {
+		t.Errorf("expected invalid MaxParallelPerRemote to fall back to the default, got %d", config.MaxParallelPerRemote)
+	}
+	if config.InitialBackoff != defaults.InitialBackoff {
+		t.Errorf("expected invalid InitialBackoff to fall back to the default, got %v", config.InitialBackoff)
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+// ImagePinnedDigestAnnotation, when set on an ImageStream, pins the whole
+// stream to an exact digest: pullthrough refuses to serve any other
+// manifest for any tag of that stream, even if the upstream registry
+// starts serving something else under the same name.
+const ImagePinnedDigestAnnotation = "openshift.io/image.pinned-digest"
+
+// trustPolicyConfigMapKey is the ConfigMap data key holding the
+// repo-prefix -> allowed key IDs / pinned digests policy, one line per
+// entry, in the format accepted by parseTrustPolicy.
+const trustPolicyConfigMapKey = "pullthrough-trust-policy"
+
+// TrustPolicy is a set of per-repository-prefix rules pullthrough
+// manifest verification is checked against: which signing key IDs are
+// trusted for a schema1 manifest, and which exact digest a repository is
+// pinned to.
+type TrustPolicy struct {
+	// AllowedKeyIDs maps a repository name prefix (e.g. "myorg/") to the
+	// libtrust JWK key IDs trusted to sign schema1 manifests under it.
+	AllowedKeyIDs map[string][]string
+	// PinnedDigests maps a repository name prefix to a digest that every
+	// manifest pulled through for it must match exactly.
+	PinnedDigests map[string]digest.Digest
+}
+
+// NewTrustPolicyFromConfigMap builds a TrustPolicy from the
+// pullthrough-trust-policy key of cm. Each line of the value has the
+// form:
+//
+//	<repo-prefix> keys=<id1>,<id2> | pin=<digest>
+//
+// Blank lines and lines starting with "#" are ignored. A malformed line
+// is skipped rather than failing the whole policy, since one operator
+// typo shouldn't take down pullthrough for every other repository.
+func NewTrustPolicyFromConfigMap(cm *kapi.ConfigMap) *TrustPolicy {
+	policy := &TrustPolicy{
+		AllowedKeyIDs: map[string][]string{},
+		PinnedDigests: map[string]digest.Digest{},
+	}
+	if cm == nil {
+		return policy
+	}
+
+	for _, line := range strings.Split(cm.Data[trustPolicyConfigMapKey], "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		prefix, rule := fields[0], fields[1]
+
+		switch {
+		case strings.HasPrefix(rule, "keys="):
+			ids := strings.Split(strings.TrimPrefix(rule, "keys="), ",")
+			policy.AllowedKeyIDs[prefix] = append(policy.AllowedKeyIDs[prefix], ids...)
+		case strings.HasPrefix(rule, "pin="):
+			policy.PinnedDigests[prefix] = digest.Digest(strings.TrimPrefix(rule, "pin="))
+		}
+	}
+
+	return policy
+}
+
+// allowedKeyIDsFor returns the trusted key IDs for repo, matching the
+// longest configured prefix. It returns ok=false when no prefix in the
+// policy matches repo, meaning signature verification should be skipped
+// for it.
+func (p *TrustPolicy) allowedKeyIDsFor(repo string) (ids []string, ok bool) {
+	var bestPrefix string
+	for prefix, keyIDs := range p.AllowedKeyIDs {
+		if strings.HasPrefix(repo, prefix) && len(prefix) >= len(bestPrefix) {
+			bestPrefix = prefix
+			ids = keyIDs
+			ok = true
+		}
+	}
+	return ids, ok
+}
+
+// pinnedDigestFor returns the digest repo is pinned to, matching the
+// longest configured prefix. ok is false when repo has no pin.
+func (p *TrustPolicy) pinnedDigestFor(repo string) (dgst digest.Digest, ok bool) {
+	var bestPrefix string
+	for prefix, pin := range p.PinnedDigests {
+		if strings.HasPrefix(repo, prefix) && len(prefix) >= len(bestPrefix) {
+			bestPrefix = prefix
+			dgst = pin
+			ok = true
+		}
+	}
+	return dgst, ok
+}
+
+// cachedTrustPolicy pairs a parsed TrustPolicy with the resource version
+// of the ConfigMap it was parsed from, so trustPolicyCache can tell a
+// stale entry from a current one without keeping every version around.
+type cachedTrustPolicy struct {
+	resourceVersion string
+	policy          *TrustPolicy
+}
+
+// trustPolicyCache holds the most recently parsed TrustPolicy for each
+// namespace that has one configured. It is bounded to one entry per
+// namespace: a new ConfigMap resource version simply overwrites the
+// namespace's existing entry rather than accumulating one entry per
+// version, so long-lived edits to a trust-policy ConfigMap don't leak
+// memory for the life of the process.
+var (
+	trustPolicyCacheMu sync.Mutex
+	trustPolicyCache   = map[string]cachedTrustPolicy{}
+)
+
+// trustPolicy returns the TrustPolicy configured for r's namespace by the
+// pullthrough-trust-policy ConfigMap, or nil if the namespace has none.
+// The ConfigMap is fetched through r.kubeClient and the parsed result is
+// cached by namespace, so repeated pullthrough requests don't re-parse it
+// on every manifest Get unless the ConfigMap has actually changed.
+func (r *repository) trustPolicy(ctx context.Context) *TrustPolicy {
+	if r.kubeClient == nil {
+		return nil
+	}
+
+	cm, err := r.kubeClient.Core().ConfigMaps(r.namespace).Get(trustPolicyConfigMapKey)
+	if err != nil {
+		context.GetLogger(r.ctx).Debugf("no pullthrough trust policy configured for namespace %q: %v", r.namespace, err)
+		return nil
+	}
+
+	trustPolicyCacheMu.Lock()
+	defer trustPolicyCacheMu.Unlock()
+	if cached, ok := trustPolicyCache[r.namespace]; ok && cached.resourceVersion == cm.ResourceVersion {
+		return cached.policy
+	}
+
+	policy := NewTrustPolicyFromConfigMap(cm)
+	trustPolicyCache[r.namespace] = cachedTrustPolicy{resourceVersion: cm.ResourceVersion, policy: policy}
+	return policy
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/digest"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func TestNewTrustPolicyFromConfigMap(t *testing.T) {
+	cm := &kapi.ConfigMap{
+		Data: map[string]string{
+			trustPolicyConfigMapKey: "" +
+				"# comment lines and blanks are ignored\n" +
+				"\n" +
+				"myorg/app keys=SHA256:aaa,SHA256:bbb\n" +
+				"myorg/app pin=sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc\n" +
+				"myorg/ keys=SHA256:default\n" +
+				"malformed line with too many fields\n",
+		},
+	}
+
+	policy := NewTrustPolicyFromConfigMap(cm)
+
+	ids, ok := policy.allowedKeyIDsFor("myorg/app")
+	if !ok {
+		t.Fatalf("expected allowed key IDs for myorg/app")
+	}
+	if len(ids) != 2 || ids[0] != "SHA256:aaa" || ids[1] != "SHA256:bbb" {
+		t.Errorf("unexpected allowed key IDs: %v", ids)
+	}
+
+	ids, ok = policy.allowedKeyIDsFor("myorg/other")
+	if !ok || len(ids) != 1 || ids[0] != "SHA256:default" {
+		t.Errorf("expected fallback to the myorg/ prefix, got %v (ok=%v)", ids, ok)
+	}
+
+	if _, ok := policy.allowedKeyIDsFor("otherorg/app"); ok {
+		t.Errorf("expected no policy for an unrelated repository")
+	}
+
+	pin, ok := policy.pinnedDigestFor("myorg/app")
+	if !ok {
+		t.Fatalf("expected a pinned digest for myorg/app")
+	}
+	if pin != digest.Digest("sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc") {
+		t.Errorf("unexpected pinned digest: %v", pin)
+	}
+}
+
+func TestNewTrustPolicyFromConfigMapNil(t *testing.T) {
+	policy := NewTrustPolicyFromConfigMap(nil)
+	if _, ok := policy.allowedKeyIDsFor("anything"); ok {
+		t.Errorf("expected no policy from a nil config map")
+	}
+}
@@ -0,0 +1,180 @@
+package xfer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// Config controls how a Manager paces and retries transfers.
+type Config struct {
+	// MaxParallelPerRemote bounds the number of concurrent transfers the
+	// manager will run against a single remote registry host.
+	MaxParallelPerRemote int
+	// MaxParallelPerRepo bounds the number of concurrent transfers the
+	// manager will run for a single remote repository.
+	MaxParallelPerRepo int
+	// RetryCount is the number of additional attempts made after a
+	// transfer fails with a retryable error.
+	RetryCount int
+	// InitialBackoff is the delay before the first retry; each
+	// subsequent retry doubles the previous delay.
+	InitialBackoff time.Duration
+}
+
+// DefaultConfig returns the configuration used when none is supplied
+// explicitly.
+func DefaultConfig() Config {
+	return Config{
+		MaxParallelPerRemote: 6,
+		MaxParallelPerRepo:   3,
+		RetryCount:           3,
+		InitialBackoff:       200 * time.Millisecond,
+	}
+}
+
+// IsRetryable classifies errors that are worth retrying with backoff,
+// such as network failures or 5xx responses from the remote registry.
+// Callers supply their own implementation since the concrete error types
+// returned by a registry client are not known to this package.
+type IsRetryable func(error) bool
+
+// Manager deduplicates concurrent transfers for the same digest and
+// rate-limits how many run in parallel against a given remote or repo.
+type Manager struct {
+	config      Config
+	isRetryable IsRetryable
+
+	mu        sync.Mutex
+	transfers map[string]*Transfer
+	remoteSem map[string]chan struct{}
+	repoSem   map[string]chan struct{}
+}
+
+// NewManager creates a Manager using config and retryable to decide
+// which errors are worth retrying.
+func NewManager(config Config, retryable IsRetryable) *Manager {
+	return &Manager{
+		config:      config,
+		isRetryable: retryable,
+		transfers:   make(map[string]*Transfer),
+		remoteSem:   make(map[string]chan struct{}),
+		repoSem:     make(map[string]chan struct{}),
+	}
+}
+
+// Transfer runs (or attaches to an already-running) fetch for dgst within
+// remote/repo, applying retry with exponential backoff on errors
+// classified as retryable. The first caller for a given digest actually
+// performs the fetch; subsequent concurrent callers for the same digest
+// block on the same result instead of issuing redundant requests. If ctx
+// is canceled while waiting, Transfer returns ctx.Err() immediately; if
+// that was the last caller still waiting on the fetch, the fetch itself
+// is aborted rather than left to run to completion for no one.
+func (m *Manager) Transfer(ctx context.Context, remote, repo string, dgst digest.Digest, do DoFunc) (interface{}, error) {
+	key := remote + "/" + repo + "@" + dgst.String()
+
+	m.mu.Lock()
+	if t, ok := m.transfers[key]; ok {
+		m.mu.Unlock()
+		return m.wait(ctx, key, t)
+	}
+
+	remoteSem := m.semaphoreFor(m.remoteSem, remote, m.config.MaxParallelPerRemote)
+	repoSem := m.semaphoreFor(m.repoSem, remote+"/"+repo, m.config.MaxParallelPerRepo)
+
+	t := newTransfer(dgst, m.throttledRetrying(remoteSem, repoSem, do))
+	m.transfers[key] = t
+	m.mu.Unlock()
+
+	return m.wait(ctx, key, t)
+}
+
+// wait blocks until t completes or ctx is canceled, whichever comes
+// first, then releases the manager's reference to t once every watcher
+// has gone away.
+func (m *Manager) wait(ctx context.Context, key string, t *Transfer) (interface{}, error) {
+	done, cancel := t.Watch()
+
+	select {
+	case <-done:
+		cancel()
+		m.release(key, t)
+		return t.Result()
+	case <-ctx.Done():
+		cancel()
+		go func() {
+			<-done
+			m.release(key, t)
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// release removes t from the manager's transfer table once nobody is
+// watching it anymore, so a later caller for the same key starts a fresh
+// transfer instead of attaching to a finished one.
+func (m *Manager) release(key string, t *Transfer) {
+	m.mu.Lock()
+	if t.activeWaiters() == 0 && m.transfers[key] == t {
+		delete(m.transfers, key)
+	}
+	m.mu.Unlock()
+}
+
+// semaphoreFor returns the named semaphore from set, creating it with
+// capacity limit if it doesn't exist yet. A limit of 0 or less means
+// unlimited concurrency, represented by a nil channel.
+func (m *Manager) semaphoreFor(set map[string]chan struct{}, name string, limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	if sem, ok := set[name]; ok {
+		return sem
+	}
+	sem := make(chan struct{}, limit)
+	set[name] = sem
+	return sem
+}
+
+// throttledRetrying wraps do so that it acquires both semaphores before
+// running and retries with exponential backoff while m.isRetryable
+// considers the failure worth another attempt.
+func (m *Manager) throttledRetrying(remoteSem, repoSem chan struct{}, do DoFunc) DoFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		acquire(remoteSem)
+		defer release(remoteSem)
+		acquire(repoSem)
+		defer release(repoSem)
+
+		backoff := m.config.InitialBackoff
+		var result interface{}
+		var err error
+		for attempt := 0; attempt <= m.config.RetryCount; attempt++ {
+			result, err = do(ctx)
+			if err == nil || m.isRetryable == nil || !m.isRetryable(err) {
+				return result, err
+			}
+			if attempt == m.config.RetryCount {
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		return result, err
+	}
+}
+
+func acquire(sem chan struct{}) {
+	if sem != nil {
+		sem <- struct{}{}
+	}
+}
+
+func release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
@@ -0,0 +1,133 @@
+package xfer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestManagerTransferDeduplicatesConcurrentCallers(t *testing.T) {
+	m := NewManager(DefaultConfig(), nil)
+
+	var calls int32
+	do := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := m.Transfer(context.Background(), "registry.example.com", "user/app", digest.Digest("sha256:abc"), do)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			results[i] = v
+		}(i)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("expected do to run exactly once, got %d calls", got)
+	}
+	for i, v := range results {
+		if v != "value" {
+			t.Errorf("result %d: expected %q, got %v", i, "value", v)
+		}
+	}
+}
+
+func TestManagerTransferRetriesRetryableErrors(t *testing.T) {
+	retryable := func(err error) bool { return err != nil }
+	m := NewManager(Config{MaxParallelPerRemote: 1, MaxParallelPerRepo: 1, RetryCount: 2, InitialBackoff: time.Millisecond}, retryable)
+
+	var attempts int32
+	do := func(ctx context.Context) (interface{}, error) {
+		n := atomic.AddInt32(&attempts, 1)
+		if n < 3 {
+			return nil, fmt.Errorf("transient failure")
+		}
+		return "ok", nil
+	}
+
+	v, err := m.Transfer(context.Background(), "registry.example.com", "user/app", digest.Digest("sha256:def"), do)
+	if err != nil {
+		t.Fatalf("unexpected error after retries: %v", err)
+	}
+	if v != "ok" {
+		t.Fatalf("expected %q, got %v", "ok", v)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestManagerTransferGivesUpAfterRetryCount(t *testing.T) {
+	retryable := func(err error) bool { return err != nil }
+	m := NewManager(Config{RetryCount: 1, InitialBackoff: time.Millisecond}, retryable)
+
+	var attempts int32
+	do := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&attempts, 1)
+		return nil, fmt.Errorf("permanent failure")
+	}
+
+	_, err := m.Transfer(context.Background(), "registry.example.com", "user/app", digest.Digest("sha256:ghi"), do)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts (1 initial + 1 retry), got %d", attempts)
+	}
+}
+
+// TestManagerTransferCancelsWhenLastWaiterGivesUp verifies that once the
+// only caller waiting on a Transfer cancels its context, the in-flight do
+// call is actually aborted instead of being left to run to completion.
+func TestManagerTransferCancelsWhenLastWaiterGivesUp(t *testing.T) {
+	m := NewManager(DefaultConfig(), nil)
+
+	started := make(chan struct{})
+	aborted := make(chan struct{})
+	do := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		close(aborted)
+		return nil, ctx.Err()
+	}
+
+	callerCtx, cancelCaller := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.Transfer(callerCtx, "registry.example.com", "user/app", digest.Digest("sha256:jkl"), do)
+		done <- err
+	}()
+
+	<-started
+	cancelCaller()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Transfer to return after the caller canceled")
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the in-flight do call to be aborted")
+	}
+}
@@ -0,0 +1,87 @@
+// Package xfer provides a manager for deduplicating and rate-limiting
+// outbound pullthrough transfers (manifest and blob fetches) issued
+// against remote registries.
+package xfer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// DoFunc performs the actual transfer (a manifest or blob fetch) for a
+// single digest, given a context that is canceled once every watcher of
+// the Transfer has gone away. It is invoked once per Transfer, plus once
+// more for each retry the Manager makes after a retryable failure, no
+// matter how many callers are waiting on it via Watch.
+type DoFunc func(ctx context.Context) (interface{}, error)
+
+// Transfer represents a single in-flight or completed fetch for one
+// digest. Multiple callers requesting the same digest concurrently are
+// attached to the same Transfer instead of starting redundant fetches. If
+// every caller stops watching before the fetch completes, the context
+// passed to do is canceled, aborting whatever request is still
+// outstanding instead of letting it run to completion for no one.
+type Transfer struct {
+	mu sync.Mutex
+
+	key digest.Digest
+
+	cancel  context.CancelFunc
+	done    chan struct{}
+	result  interface{}
+	err     error
+	waiters int
+}
+
+// newTransfer creates a Transfer for key and runs do in its own
+// goroutine, fanning its result out to every Watch call.
+func newTransfer(key digest.Digest, do DoFunc) *Transfer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Transfer{
+		key:    key,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		t.result, t.err = do(ctx)
+		close(t.done)
+	}()
+	return t
+}
+
+// Watch registers the caller as a waiter on t and returns a channel that
+// is closed once the underlying transfer completes, along with a cancel
+// function the caller must call when it is no longer interested. Once the
+// last remaining watcher cancels, t's context is canceled so the do call
+// backing it can abort.
+func (t *Transfer) Watch() (result <-chan struct{}, cancel func()) {
+	t.mu.Lock()
+	t.waiters++
+	t.mu.Unlock()
+
+	return t.done, func() {
+		t.mu.Lock()
+		t.waiters--
+		remaining := t.waiters
+		t.mu.Unlock()
+
+		if remaining == 0 {
+			t.cancel()
+		}
+	}
+}
+
+// Result returns the outcome of the transfer. It must only be called
+// after the channel returned by Watch has been closed.
+func (t *Transfer) Result() (interface{}, error) {
+	return t.result, t.err
+}
+
+// activeWaiters reports how many callers are currently attached to t.
+func (t *Transfer) activeWaiters() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.waiters
+}